@@ -2,10 +2,13 @@ package dicomio
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/hxhxhx88/go-dicom/dicomlog"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 // CodingSystem defines how a []byte is translated into a utf8 string.
@@ -21,8 +24,63 @@ type CodingSystem struct {
 	Alphabetic  *encoding.Decoder
 	Ideographic *encoding.Decoder
 	Phonetic    *encoding.Decoder
+
+	// Policy records the CharsetPolicy that ParseSpecificCharacterSet was
+	// called with, so that later decoding of individual elements can honor
+	// the same leniency.
+	Policy CharsetPolicy
+
+	// alphabeticName, ideographicName and phoneticName record the
+	// normalized DICOM charset name each decoder above was resolved from
+	// ("" for 7bit ASCII), so that EncodeString can pick a matching
+	// encoder for the write-side counterpart of Decode.
+	alphabeticName  string
+	ideographicName string
+	phoneticName    string
+
+	// preferGB18030 records ReadOptions.PreferGB18030ForChinese, so that
+	// decoders resolved later (e.g. across an ISO 2022 escape sequence in
+	// Decode) apply the same GB18030 substitution as the initial parse.
+	preferGB18030 bool
+}
+
+// ReadOptions controls how ParseSpecificCharacterSet, and the CodingSystem
+// it returns, resolve DICOM charset names into golang.org/x/text decoders.
+type ReadOptions struct {
+	// Policy controls what happens when a charset name isn't recognized.
+	// The zero value, CharsetPolicyStrict, is the historical behavior.
+	Policy CharsetPolicy
+	// PreferGB18030ForChinese substitutes a GB18030 decoder (a strict
+	// superset of GB2312/GBK) for "ISO 2022 IR 58", instead of the gb2312
+	// (really GBK) decoder htmlindex would otherwise return. A decoder
+	// registered for that name via RegisterCharset still takes priority.
+	// This sidesteps golang.org/x/text sometimes mapping ISO-2022-CN-family
+	// labels to its "replacement" decoder, which would otherwise silently
+	// turn every subsequent byte into U+FFFD; see the comment above
+	// htmlEncodingNames["ISO 2022 IR 58"] for the full story.
+	PreferGB18030ForChinese bool
 }
 
+// CharsetPolicy controls how ParseSpecificCharacterSet and the string
+// decoding paths react to a DICOM character set name they don't recognize,
+// or to bytes that don't decode cleanly under the chosen encoding.Decoder.
+type CharsetPolicy int
+
+const (
+	// CharsetPolicyStrict fails the parse on an unknown charset name. This
+	// is the historical behavior.
+	CharsetPolicyStrict CharsetPolicy = iota
+	// CharsetPolicyLenient logs a warning and falls back to ISO-8859-1 (the
+	// "ISO 2022 IR 6" repertoire) for an unknown charset name, rather than
+	// aborting the whole dataset parse.
+	CharsetPolicyLenient
+	// CharsetPolicyLenientReplace behaves like CharsetPolicyLenient for
+	// unknown names, and additionally replaces bytes that don't decode
+	// cleanly through the chosen decoder with U+FFFD instead of giving up
+	// on the rest of the string.
+	CharsetPolicyLenientReplace
+)
+
 // CodingSystemType defines the where the coding system is going to be
 // used. This distinction is useful in Japanese, but of little use in other
 // languages.
@@ -97,11 +155,112 @@ var htmlEncodingNames = map[string]string{
 	"ISO 2022 IR 58": "gb2312",
 }
 
+// CharsetFactory builds a decoder for a DICOM-registered character set name.
+// It is called once per lookup, so implementations that wrap a stateful
+// golang.org/x/text encoding should return a fresh *encoding.Decoder every
+// time.
+type CharsetFactory func() *encoding.Decoder
+
+var charsetRegistryMu sync.RWMutex
+
+// registeredCharsets holds user-supplied decoders, keyed by normalized DICOM
+// charset name (see normalizeCharsetName). Entries here take priority over
+// htmlEncodingNames, so callers can override the built-in mapping too.
+var registeredCharsets = map[string]CharsetFactory{}
+
+// registeredAliases maps a normalized alias name to a normalized canonical
+// DICOM charset name that is looked up in registeredCharsets/htmlEncodingNames.
+var registeredAliases = map[string]string{}
+
+// RegisterCharset teaches ParseSpecificCharacterSet about a DICOM character
+// set name that isn't in the built-in table, or overrides the decoder used
+// for one that is. name is matched case-insensitively and with whitespace
+// collapsed, per normalizeCharsetName.
+func RegisterCharset(name string, factory CharsetFactory) {
+	charsetRegistryMu.Lock()
+	defer charsetRegistryMu.Unlock()
+	registeredCharsets[normalizeCharsetName(name)] = factory
+}
+
+// RegisterCharsetAlias maps a non-conformant or vendor spelling of a charset
+// name (alias) to the canonical DICOM name that should be used to resolve it,
+// e.g. a vendor that writes "ISO-IR 100" instead of "ISO_IR 100". Both names
+// are matched case-insensitively and with whitespace collapsed.
+func RegisterCharsetAlias(alias, canonical string) {
+	charsetRegistryMu.Lock()
+	defer charsetRegistryMu.Unlock()
+	registeredAliases[normalizeCharsetName(alias)] = normalizeCharsetName(canonical)
+}
+
+// normalizeCharsetName trims leading/trailing whitespace, uppercases, and
+// collapses runs of internal whitespace to a single space, so that e.g.
+// "iso_ir  100 " and "ISO_IR 100" resolve identically. An empty or
+// whitespace-only name is treated as "ISO 2022 IR 6" (default character
+// repertoire), matching the leniency fo-dicom applies for the "spaces in
+// charset name" issue.
+func normalizeCharsetName(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		return "ISO 2022 IR 6"
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// resolveCharsetDecoder looks up the decoder for a (possibly non-normalized)
+// DICOM charset name, consulting user-registered aliases and decoders before
+// the built-in htmlEncodingNames table. It returns ok=false if the name is
+// not recognized anywhere.
+//
+// preferGB18030 is ReadOptions.PreferGB18030ForChinese; when set, it
+// substitutes a GB18030 decoder for "ISO 2022 IR 58" (unless one is
+// registered for that name) instead of the gb2312 (which htmlindex maps to
+// GBK) decoder htmlindex would otherwise
+// return, since GB18030 is a strict superset of both and is at least as
+// likely to be what htmlindex would hand back for the "replacement" decoder
+// case documented there.
+func resolveCharsetDecoder(name string, preferGB18030 bool) (d *encoding.Decoder, ok bool) {
+	normalized := normalizeCharsetName(name)
+
+	charsetRegistryMu.RLock()
+	if canonical, isAlias := registeredAliases[normalized]; isAlias {
+		normalized = canonical
+	}
+	if factory, found := registeredCharsets[normalized]; found {
+		charsetRegistryMu.RUnlock()
+		return factory(), true
+	}
+	charsetRegistryMu.RUnlock()
+
+	if preferGB18030 && normalized == "ISO 2022 IR 58" {
+		dicomlog.Vprintf(0, "dicomio.resolveCharsetDecoder: substituting GB18030 for %s per ReadOptions.PreferGB18030ForChinese", normalized)
+		return simplifiedchinese.GB18030.NewDecoder(), true
+	}
+	htmlName, found := htmlEncodingNames[normalized]
+	if !found {
+		return nil, false
+	}
+	if htmlName == "" {
+		return nil, true
+	}
+	enc, err := htmlindex.Get(htmlName)
+	if err != nil {
+		panic(fmt.Sprintf("Encoding name %s (for %s) not found", normalized, htmlName))
+	}
+	return enc.NewDecoder(), true
+}
+
 // ParseSpecificCharacterSet converts DICOM character encoding names, such as
 // "ISO-IR 100" to golang decoder. It will return nil, nil for the default (7bit
 // ASCII) encoding. Cf. P3.2
 // D.6.2. http://dicom.nema.org/medical/dicom/2016d/output/chtml/part02/sect_D.6.2.html
-func ParseSpecificCharacterSet(encodingNames []string) (CodingSystem, error) {
+//
+// opts.Policy controls what happens when encodingNames contains a name that
+// isn't recognized by resolveCharsetDecoder: CharsetPolicyStrict returns an
+// error, while the Lenient variants fall back to "ISO 2022 IR 6"
+// (ISO-8859-1) with a logged warning, matching the leniency fo-dicom applies
+// for malformed SpecificCharacterSet values. See ReadOptions for the other
+// options.
+func ParseSpecificCharacterSet(encodingNames []string, opts ReadOptions) (CodingSystem, error) {
 	// Set the []byte -> string decoder for the rest of the
 	// file.  It's sad that SpecificCharacterSet isn't part
 	// of metadata, but is part of regular attrs, so we need
@@ -112,31 +271,52 @@ func ParseSpecificCharacterSet(encodingNames []string) (CodingSystem, error) {
 	//return CodingSystem{}, err
 	//}
 	var decoders []*encoding.Decoder
+	var names []string
 	for _, name := range encodingNames {
-		var c *encoding.Decoder
 		dicomlog.Vprintf(2, "dicom.ParseSpecificCharacterSet: Using coding system %s", name)
-		if htmlName, ok := htmlEncodingNames[name]; !ok {
-			// TODO(saito) Support more encodings.
-			return CodingSystem{}, fmt.Errorf("dicom.ParseSpecificCharacterSet: Unknown character set '%s'. Assuming utf-8", name)
-		} else {
-			if htmlName != "" {
-				d, err := htmlindex.Get(htmlName)
-				if err != nil {
-					panic(fmt.Sprintf("Encoding name %s (for %s) not found", name, htmlName))
-				}
-				c = d.NewDecoder()
+		c, ok := resolveCharsetDecoder(name, opts.PreferGB18030ForChinese)
+		normalized := normalizeCharsetName(name)
+		if !ok {
+			if opts.Policy == CharsetPolicyStrict {
+				// TODO(saito) Support more encodings.
+				return CodingSystem{}, fmt.Errorf("dicom.ParseSpecificCharacterSet: Unknown character set '%s'. Assuming utf-8", name)
 			}
+			dicomlog.Vprintf(0, "dicom.ParseSpecificCharacterSet: Unknown character set '%s', falling back to ISO-8859-1 per lenient charset policy", name)
+			normalized = "ISO 2022 IR 6"
+			c, _ = resolveCharsetDecoder(normalized, opts.PreferGB18030ForChinese)
 		}
 		decoders = append(decoders, c)
+		names = append(names, normalized)
 	}
 	if len(decoders) == 0 {
-		return CodingSystem{nil, nil, nil}, nil
+		return CodingSystem{Policy: opts.Policy, preferGB18030: opts.PreferGB18030ForChinese}, nil
 	}
 	if len(decoders) == 1 {
-		return CodingSystem{decoders[0], decoders[0], decoders[0]}, nil
+		return CodingSystem{
+			Alphabetic: decoders[0], Ideographic: decoders[0], Phonetic: decoders[0],
+			Policy:          opts.Policy,
+			preferGB18030:   opts.PreferGB18030ForChinese,
+			alphabeticName:  names[0],
+			ideographicName: names[0],
+			phoneticName:    names[0],
+		}, nil
 	}
 	if len(decoders) == 2 {
-		return CodingSystem{decoders[0], decoders[1], decoders[1]}, nil
+		return CodingSystem{
+			Alphabetic: decoders[0], Ideographic: decoders[1], Phonetic: decoders[1],
+			Policy:          opts.Policy,
+			preferGB18030:   opts.PreferGB18030ForChinese,
+			alphabeticName:  names[0],
+			ideographicName: names[1],
+			phoneticName:    names[1],
+		}, nil
 	}
-	return CodingSystem{decoders[0], decoders[1], decoders[2]}, nil
+	return CodingSystem{
+		Alphabetic: decoders[0], Ideographic: decoders[1], Phonetic: decoders[2],
+		Policy:          opts.Policy,
+		preferGB18030:   opts.PreferGB18030ForChinese,
+		alphabeticName:  names[0],
+		ideographicName: names[1],
+		phoneticName:    names[2],
+	}, nil
 }
@@ -0,0 +1,219 @@
+package dicomio
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// extensionVRs lists the VR types for which code extension (switching the
+// designated character set mid-value via an ISO 2022 escape sequence) is
+// permitted. See P3.5 6.2.
+var extensionVRs = map[string]bool{
+	"PN": true,
+	"LO": true,
+	"LT": true,
+	"SH": true,
+	"ST": true,
+	"UT": true,
+}
+
+// iso2022Escapes maps an ISO 2022 escape sequence (as raw bytes, ESC
+// included) to the DICOM charset name it designates, for the G0/G1 sets that
+// htmlEncodingNames already knows how to decode. It covers the 94-character
+// sets ISO-IR 6/13/14/87/159 and the 96-character sets ISO-IR
+// 100/101/109/110/126/127/138/144/148/166. Keys are tried longest-first by
+// scanISO2022Escape, so a 4-byte multi-byte designator is matched before any
+// 3-byte one.
+var iso2022Escapes = map[string]string{
+	"\x1b(B":  "ISO 2022 IR 6",   // ASCII, designated to G0
+	"\x1b(J":  "ISO 2022 IR 13",  // JIS X 0201 Roman, designated to G0
+	"\x1b)I":  "ISO 2022 IR 13",  // JIS X 0201 Katakana, designated to G1
+	"\x1b-A":  "ISO 2022 IR 100", // ISO 8859-1, designated to G1
+	"\x1b-B":  "ISO 2022 IR 101", // ISO 8859-2
+	"\x1b-C":  "ISO 2022 IR 109", // ISO 8859-3
+	"\x1b-D":  "ISO 2022 IR 110", // ISO 8859-4
+	"\x1b-F":  "ISO 2022 IR 126", // ISO 8859-7 (Greek)
+	"\x1b-G":  "ISO 2022 IR 127", // ISO 8859-6 (Arabic)
+	"\x1b-H":  "ISO 2022 IR 138", // ISO 8859-8 (Hebrew)
+	"\x1b-L":  "ISO 2022 IR 144", // ISO 8859-5 (Cyrillic)
+	"\x1b-M":  "ISO 2022 IR 148", // ISO 8859-9 (Latin 5)
+	"\x1b-T":  "ISO 2022 IR 166", // TIS 620-2533 (Thai)
+	"\x1b$@":  "ISO 2022 IR 87",  // JIS X 0208-1978, multi-byte
+	"\x1b$B":  "ISO 2022 IR 87",  // JIS X 0208-1990, multi-byte
+	"\x1b$(D": "ISO 2022 IR 159", // JIS X 0212, multi-byte
+	"\x1b$)C": "ISO 2022 IR 149", // KS X 1001, multi-byte
+	"\x1b$)A": "ISO 2022 IR 58",  // GB 2312, multi-byte
+}
+
+// scanISO2022Escape checks whether data[pos:] starts with a recognized ISO
+// 2022 escape sequence (data[pos] must already be ESC). It tries the longest
+// known sequences first: each 4-byte sequence (e.g. "\x1b$)C") is tried
+// before the 3-byte ones. It returns the number of bytes the
+// sequence occupies (including ESC) and the DICOM charset name it
+// designates, or ok=false if nothing matched.
+func scanISO2022Escape(data []byte, pos int) (n int, dicomName string, ok bool) {
+	for _, l := range [2]int{4, 3} {
+		if pos+l > len(data) {
+			continue
+		}
+		if name, found := iso2022Escapes[string(data[pos:pos+l])]; found {
+			return l, name, true
+		}
+	}
+	return 0, "", false
+}
+
+// Decode converts the raw element bytes for a string VR into a utf8 string.
+// For VRs that permit code extension (see extensionVRs), the byte stream is
+// scanned for ISO 2022 escape sequences and each run between escapes is
+// decoded with whatever decoder is currently designated, rather than running
+// the whole buffer through a single decoder chosen up front. PN additionally
+// splits on '=' into up to three representation groups (alphabetic,
+// ideographic, phonetic per P3.5 6.2), each starting from its own default
+// decoder before any escape sequence is seen; '^' is the separator between
+// the name components (family^given^middle^prefix^suffix) within a single
+// group, not between groups, so it's left alone here.
+func (cs CodingSystem) Decode(vr string, data []byte) (string, error) {
+	if !extensionVRs[vr] {
+		return decodeRun(cs.Ideographic, data, cs.Policy)
+	}
+	if vr != "PN" {
+		return cs.decodeComponent(cs.ideographicName, cs.Ideographic, data)
+	}
+	groups := bytes.SplitN(data, []byte("="), 3)
+	defaultNames := [3]string{cs.alphabeticName, cs.ideographicName, cs.phoneticName}
+	defaultDecoders := [3]*encoding.Decoder{cs.Alphabetic, cs.Ideographic, cs.Phonetic}
+	decoded := make([]string, len(groups))
+	for i, group := range groups {
+		s, err := cs.decodeComponent(defaultNames[i], defaultDecoders[i], group)
+		if err != nil {
+			return "", err
+		}
+		decoded[i] = s
+	}
+	return strings.Join(decoded, "="), nil
+}
+
+// escAwareName reports whether the golang.org/x/text decoder resolved for a
+// DICOM charset name is itself a stateful ISO 2022 codec that expects to see
+// designator escape sequences in its input and switch its own internal
+// state accordingly — true today only for "iso-2022-jp" (ISO 2022 IR
+// 87/159). For these, decodeComponent must not strip the escape bytes out
+// and hand the runs to fresh decoder instances the way it does for charsets
+// with no native ESC awareness (the ISO-8859-* single byte sets, euc-kr,
+// gb2312/GBK, ...); doing so would reset the codec to its default ASCII
+// state and leave it never knowing it should be in 2-byte JIS mode.
+func escAwareName(name string) bool {
+	return htmlEncodingNames[normalizeCharsetName(name)] == "iso-2022-jp"
+}
+
+// decodeComponent decodes a single PN representation group (or a whole
+// non-PN value), tracking the currently designated decoder across ISO 2022
+// escape sequences. defName/def are the charset name and decoder in effect
+// before any escape sequence is encountered, i.e. the ones
+// ParseSpecificCharacterSet chose for this group's position in the
+// SpecificCharacterSet value list.
+//
+// Escapes that merely redesignate within the same ESC-aware codec (e.g. the
+// JIS X 0201/0208/0212 designators that all end up driving the same
+// iso-2022-jp decoder) are left untouched in the run, since that decoder
+// tracks its own internal state from seeing them. An escape that switches to
+// a charset needing a *different* decoder — whether that's two genuinely
+// different ESC-aware codecs, an ESC-aware one to a non-aware one, or
+// between two non-aware ones — always ends the current run and starts a
+// fresh one, so a single legal value can freely mix e.g. "ISO 2022 IR
+// 100\ISO 2022 IR 87" without one decoder silently swallowing the other's
+// escapes.
+func (cs CodingSystem) decodeComponent(defName string, def *encoding.Decoder, data []byte) (string, error) {
+	var sb strings.Builder
+	currentName := defName
+	current := def
+	runStart := 0
+	for i := 0; i < len(data); {
+		if data[i] != 0x1b {
+			i++
+			continue
+		}
+		escLen, name, ok := scanISO2022Escape(data, i)
+		if !ok {
+			i++
+			continue
+		}
+		if escAwareName(currentName) && escAwareName(name) {
+			// Redesignation within the same stateful codec: leave the
+			// escape bytes where they are for it to interpret itself.
+			i += escLen
+			continue
+		}
+		s, err := decodeRun(current, data[runStart:i], cs.Policy)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(s)
+		if d, found := resolveCharsetDecoder(name, cs.preferGB18030); found {
+			current = d
+		}
+		currentName = name
+		if escAwareName(name) {
+			// The new charset manages its own escapes; keep this one
+			// in the next run instead of stripping it out.
+			runStart = i
+		} else {
+			runStart = i + escLen
+		}
+		i += escLen
+	}
+	s, err := decodeRun(current, data[runStart:], cs.Policy)
+	if err != nil {
+		return "", err
+	}
+	sb.WriteString(s)
+	return sb.String(), nil
+}
+
+// decodeRun decodes a single run of bytes using d. The run holds no escape
+// sequences except those an ESC-aware decoder (see escAwareName) interprets
+// itself. A nil d means 7-bit ASCII, which is passed through as-is. On a
+// decode error, CharsetPolicyLenientReplace retries byte-by-byte, replacing
+// whatever didn't decode cleanly with U+FFFD instead of aborting.
+func decodeRun(d *encoding.Decoder, data []byte, policy CharsetPolicy) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	if d == nil {
+		return string(data), nil
+	}
+	out, err := d.Bytes(data)
+	if err == nil {
+		return string(out), nil
+	}
+	if policy != CharsetPolicyLenientReplace {
+		return string(out), err
+	}
+	return decodeReplacingInvalid(d, data), nil
+}
+
+// decodeReplacingInvalid decodes data with d, substituting U+FFFD for
+// whatever byte(s) caused a decode failure and resuming decoding right
+// after, rather than giving up on the remainder of the run.
+func decodeReplacingInvalid(d *encoding.Decoder, data []byte) string {
+	var sb strings.Builder
+	for len(data) > 0 {
+		out, n, err := transform.Bytes(d, data)
+		sb.Write(out)
+		if err == nil {
+			break
+		}
+		sb.WriteRune(utf8.RuneError)
+		if n >= len(data) {
+			break
+		}
+		data = data[n+1:]
+		d.Reset()
+	}
+	return sb.String()
+}
@@ -0,0 +1,91 @@
+package dicomio
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// isoJPEncode encodes s as ISO-2022-JP, via transform.NewWriter+Close so the
+// encoder emits whatever trailing reset-to-ASCII escape it needs, the same
+// way a real writer would.
+func isoJPEncode(t *testing.T, s string) []byte {
+	t.Helper()
+	enc, err := htmlindex.Get("iso-2022-jp")
+	if err != nil {
+		t.Fatalf("htmlindex.Get(iso-2022-jp): %v", err)
+	}
+	var buf bytes.Buffer
+	w := transform.NewWriter(&buf, enc.NewEncoder())
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatalf("encode %q: %v", s, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close encoder for %q: %v", s, err)
+	}
+	return buf.Bytes()
+}
+
+// TestDecodePNJapaneseRoundTrip covers the flagship case from chunk0-3: a PN
+// value with an Alphabetic representation group and an ISO 2022 IR
+// 87-encoded Ideographic group, separated by '=', where the ideographic
+// group itself interleaves ASCII ('^') and Kanji.
+func TestDecodePNJapaneseRoundTrip(t *testing.T) {
+	ideographic := isoJPEncode(t, "山田^太郎")
+	raw := append([]byte("Yamada^Tarou="), ideographic...)
+
+	cs, err := ParseSpecificCharacterSet([]string{"", "ISO 2022 IR 87"}, ReadOptions{})
+	if err != nil {
+		t.Fatalf("ParseSpecificCharacterSet: %v", err)
+	}
+
+	got, err := cs.Decode("PN", raw)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if want := "Yamada^Tarou=山田^太郎"; got != want {
+		t.Errorf("Decode() = %q, want %q", got, want)
+	}
+}
+
+// TestDecodeMixedDesignatorsNoLeak reproduces the bug reported against
+// 3b7d15a: a value that switches from an ESC-aware charset (ISO 2022 IR 87,
+// decoded with iso-2022-jp) to an unrelated non-ESC-aware one (ISO 2022 IR
+// 126, Greek) must decode the Greek text correctly and must not leak
+// designator bytes into the output, with no error even under
+// CharsetPolicyStrict.
+func TestDecodeMixedDesignatorsNoLeak(t *testing.T) {
+	kanji := isoJPEncode(t, "山")
+
+	greekEnc, err := htmlindex.Get("iso-8859-7")
+	if err != nil {
+		t.Fatalf("htmlindex.Get(iso-8859-7): %v", err)
+	}
+	greek, err := greekEnc.NewEncoder().Bytes([]byte("α"))
+	if err != nil {
+		t.Fatalf("encode greek: %v", err)
+	}
+
+	var raw []byte
+	raw = append(raw, 'A')
+	raw = append(raw, kanji...)
+	raw = append(raw, 'B')
+	raw = append(raw, "\x1b-F"...)
+	raw = append(raw, greek...)
+	raw = append(raw, "end"...)
+
+	cs, err := ParseSpecificCharacterSet([]string{"", "ISO 2022 IR 87"}, ReadOptions{Policy: CharsetPolicyStrict})
+	if err != nil {
+		t.Fatalf("ParseSpecificCharacterSet: %v", err)
+	}
+
+	got, err := cs.Decode("LO", raw)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if want := "A山Bαend"; got != want {
+		t.Errorf("Decode() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+package dicomio
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/hxhxhx88/go-dicom/dicomlog"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// UnencodableRunePolicy controls what ChooseCharacterSet does when a string
+// can't be represented in the requested output charset. EncodeString takes no
+// policy and always returns an error in that case.
+type UnencodableRunePolicy int
+
+const (
+	// UnencodableRuneError fails with an error when the requested charset
+	// can't represent the string.
+	UnencodableRuneError UnencodableRunePolicy = iota
+	// UnencodableRuneFallbackUTF8 silently switches to "ISO_IR 192"
+	// (UTF-8), which can represent any Go string, instead of failing.
+	UnencodableRuneFallbackUTF8
+)
+
+// WriteOptions controls how strings are encoded when writing a DICOM
+// dataset, mirroring the read-side CharsetPolicy.
+type WriteOptions struct {
+	// PreferredCharset is the DICOM charset name to encode output strings
+	// with, e.g. "ISO_IR 192" for UTF-8. Empty means "ISO 2022 IR 6"
+	// (7bit ASCII). Nothing in this package reads this field:
+	// ChooseCharacterSet takes the preferred name as its own argument and
+	// canonicalizes that via CanonicalizeCharsetName.
+	PreferredCharset string
+	// OnUnencodable says what to do when PreferredCharset can't represent
+	// a string that needs to be written.
+	OnUnencodable UnencodableRunePolicy
+}
+
+// CanonicalizeCharsetName fixes common non-conformant spellings of a DICOM
+// charset name before it's used to choose a writer encoding. In particular
+// it proactively fixes the fo-dicom-style "ISO IR 192" vs "ISO_IR 192" bug:
+// DICOM joins "ISO" and "IR" with an underscore for the single-byte
+// character sets (e.g. "ISO_IR 100", "ISO_IR 192"), but uses "ISO 2022 IR
+// ..." (literal "2022", space-separated) for the code-extension ones, and
+// the two are easy to confuse.
+func CanonicalizeCharsetName(name string) string {
+	normalized := normalizeCharsetName(name)
+	if strings.HasPrefix(normalized, "ISO IR ") {
+		normalized = "ISO_IR " + strings.TrimPrefix(normalized, "ISO IR ")
+	}
+	return normalized
+}
+
+// ChooseCharacterSet picks the DICOM charset name(s) to write to the
+// SpecificCharacterSet (0008,0005) element so that s can be encoded. If
+// preferred (a DICOM charset name, canonicalized internally) can represent
+// every rune in s, it alone is returned. Otherwise, per
+// opts.OnUnencodable, ChooseCharacterSet either errors, or falls back to
+// "ISO_IR 192" (UTF-8), which can always represent s. Callers write the
+// returned name(s) as the value(s) of a SpecificCharacterSet element ahead
+// of the attributes encoded with them.
+func ChooseCharacterSet(s string, preferred string, opts WriteOptions) ([]string, error) {
+	name := CanonicalizeCharsetName(preferred)
+	if canEncodeCharset(name, s) {
+		return []string{name}, nil
+	}
+	if opts.OnUnencodable != UnencodableRuneFallbackUTF8 {
+		return nil, fmt.Errorf("dicomio.ChooseCharacterSet: %q cannot be represented in charset %q", s, name)
+	}
+	dicomlog.Vprintf(0, "dicomio.ChooseCharacterSet: %q doesn't fit in %s, falling back to ISO_IR 192 (UTF-8)", s, name)
+	return []string{"ISO_IR 192"}, nil
+}
+
+// canEncodeCharset reports whether every rune of s can be represented by the
+// (already canonicalized) DICOM charset name.
+func canEncodeCharset(name string, s string) bool {
+	if name == "ISO 2022 IR 6" {
+		return isASCII(s)
+	}
+	if name == "ISO_IR 192" {
+		return true // UTF-8 represents any Go string.
+	}
+	htmlName, ok := htmlEncodingNames[name]
+	if !ok || htmlName == "" {
+		return isASCII(s)
+	}
+	enc, err := htmlindex.Get(htmlName)
+	if err != nil {
+		return false
+	}
+	_, err = enc.NewEncoder().String(s)
+	return err == nil
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeString is the write-side counterpart of Decode: it converts a
+// decoded string back into raw DICOM element bytes using the charset
+// name(s) this CodingSystem was built from (see ParseSpecificCharacterSet).
+// Like Decode, PN is split on '=' into up to three representation groups
+// (alphabetic, ideographic, phonetic per P3.5 6.2), each encoded with its
+// own charset; '^' separates the name components (family^given^middle^
+// prefix^suffix) within a group, not groups themselves, so it's left alone
+// here. Every other VR is encoded as a single run with the Ideographic
+// charset. A charset name with no entry in htmlEncodingNames (e.g. one known
+// only through RegisterCharset or RegisterCharsetAlias) has no encoder here,
+// and s is returned as its UTF-8 bytes, unconverted.
+func (cs CodingSystem) EncodeString(vr string, s string) ([]byte, error) {
+	if vr != "PN" {
+		return encodeWithCharset(cs.ideographicName, s)
+	}
+	groups := strings.SplitN(s, "=", 3)
+	names := [3]string{cs.alphabeticName, cs.ideographicName, cs.phoneticName}
+	var buf bytes.Buffer
+	for i, group := range groups {
+		if i > 0 {
+			buf.WriteByte('=')
+		}
+		b, err := encodeWithCharset(names[i], group)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeWithCharset encodes s with the DICOM charset name, which must
+// already be normalized (or "" for 7bit ASCII).
+func encodeWithCharset(name string, s string) ([]byte, error) {
+	if name == "" || name == "ISO 2022 IR 6" {
+		if !isASCII(s) {
+			return nil, fmt.Errorf("dicomio.EncodeString: %q is not 7bit ASCII and no charset is designated", s)
+		}
+		return []byte(s), nil
+	}
+	htmlName, ok := htmlEncodingNames[name]
+	if !ok || htmlName == "" {
+		return []byte(s), nil
+	}
+	enc, err := htmlindex.Get(htmlName)
+	if err != nil {
+		panic(fmt.Sprintf("Encoding name %s (for %s) not found", name, htmlName))
+	}
+	out, err := enc.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("dicomio.EncodeString: %w", err)
+	}
+	return out, nil
+}
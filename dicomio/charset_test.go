@@ -0,0 +1,41 @@
+package dicomio
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// TestResolveCharsetDecoderPreferGB18030 covers chunk0-5: with
+// PreferGB18030ForChinese (threaded through as preferGB18030 here),
+// resolveCharsetDecoder must hand back a GB18030 decoder for "ISO 2022 IR
+// 58", able to decode runes (like U+20000, CJK Extension B) that GB2312/GBK
+// can't represent; without the preference, the plain gb2312 (really GBK, see
+// htmlEncodingNames) decoder is used instead and fails on the same bytes.
+func TestResolveCharsetDecoderPreferGB18030(t *testing.T) {
+	const want = "\U00020000" // U+20000, representable in GB18030 but not GBK/GB2312.
+	encoded, err := simplifiedchinese.GB18030.NewEncoder().Bytes([]byte(want))
+	if err != nil {
+		t.Fatalf("GB18030 encode %q: %v", want, err)
+	}
+
+	d, ok := resolveCharsetDecoder("ISO 2022 IR 58", true)
+	if !ok {
+		t.Fatalf(`resolveCharsetDecoder("ISO 2022 IR 58", true) not found`)
+	}
+	got, err := d.Bytes(encoded)
+	if err != nil {
+		t.Fatalf("decode with PreferGB18030ForChinese decoder: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("decoded = %q, want %q", got, want)
+	}
+
+	plain, ok := resolveCharsetDecoder("ISO 2022 IR 58", false)
+	if !ok {
+		t.Fatalf(`resolveCharsetDecoder("ISO 2022 IR 58", false) not found`)
+	}
+	if _, err := plain.Bytes(encoded); err == nil {
+		t.Errorf("expected a decode error from the non-GB18030 decoder for %q", want)
+	}
+}